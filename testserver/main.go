@@ -10,7 +10,7 @@ import (
 func main() {
 	fmt.Println("Starting Test Server")
 
-	websockets := []*websocket.WebSocket{}
+	hub := websocket.NewHub()
 
 	http.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "web/index.html")
@@ -20,7 +20,7 @@ func main() {
 		// fmt.Println("WebSocket endpoint hit")
 		// PrintRequestHeaders(r)
 
-		ws, err := websocket.Upgrade(w, r)
+		ws, err := websocket.Upgrade(w, r, nil)
 		if err != nil {
 			fmt.Println(err.Error())
 			http.Error(w, "Could not upgrade to WebSocket", http.StatusInternalServerError)
@@ -28,9 +28,7 @@ func main() {
 		}
 
 		ws.ReceiveTextHandler = (func(ws *websocket.WebSocket, message string) {
-			for _, other_ws := range websockets {
-				other_ws.SendText(message)
-			}
+			hub.BroadcastText(message)
 			//fmt.Println("Received message:", string(message))
 		})
 
@@ -38,7 +36,7 @@ func main() {
 			fmt.Printf("WebSocket %d closed\n", ws.ID)
 		})
 
-		websockets = append(websockets, ws)
+		hub.Join(ws)
 
 		ws.SendText("Welcome to the Chat!")
 	})
@@ -0,0 +1,210 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DialOptions configures a single Dial call.
+type DialOptions struct {
+	NetDialer        *net.Dialer
+	TLSClientConfig  *tls.Config
+	HandshakeTimeout time.Duration
+	Subprotocols     []string
+	Extensions       []string
+	Header           http.Header
+}
+
+// Dialer mirrors the standard library's http.Client / net.Dialer pattern:
+// it holds reusable connection settings that apply to every Dial call made
+// through it.
+type Dialer struct {
+	NetDialer        *net.Dialer
+	TLSClientConfig  *tls.Config
+	HandshakeTimeout time.Duration
+	Subprotocols     []string
+}
+
+// Dial opens a client WebSocket connection to rawURL using a zero-value
+// Dialer configured from opts. See Dialer.Dial for details.
+func Dial(rawURL string, opts *DialOptions) (*WebSocket, *http.Response, error) {
+	if opts == nil {
+		opts = &DialOptions{}
+	}
+	d := &Dialer{
+		NetDialer:        opts.NetDialer,
+		TLSClientConfig:  opts.TLSClientConfig,
+		HandshakeTimeout: opts.HandshakeTimeout,
+		Subprotocols:     opts.Subprotocols,
+	}
+	return d.Dial(rawURL, opts.Header, opts.Extensions)
+}
+
+// Dial performs the client handshake described in RFC 6455 section 4.1: it
+// opens a TCP or TLS connection to rawURL (scheme ws:// or wss://), sends a
+// compliant upgrade request, and verifies the server's response before
+// handing the connection to the package's normal read loop.
+func (d *Dialer) Dial(rawURL string, header http.Header, extensions []string) (*WebSocket, *http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var use_tls bool
+	switch u.Scheme {
+	case "ws":
+		use_tls = false
+	case "wss":
+		use_tls = true
+	default:
+		return nil, nil, fmt.Errorf("Unsupported WebSocket URL scheme: %s", u.Scheme)
+	}
+
+	host := u.Host
+	if !strings.Contains(host, ":") {
+		if use_tls {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+
+	net_dialer := d.NetDialer
+	if net_dialer == nil {
+		net_dialer = &net.Dialer{}
+	}
+
+	conn, err := net_dialer.Dial("tcp", host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if d.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.HandshakeTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if use_tls {
+		tls_config := d.TLSClientConfig
+		if tls_config == nil {
+			tls_config = &tls.Config{}
+		}
+		if tls_config.ServerName == "" {
+			tls_config = tls_config.Clone()
+			tls_config.ServerName = u.Hostname()
+		}
+		tls_conn := tls.Client(conn, tls_config)
+		if err := tls_conn.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tls_conn
+	}
+
+	if !incrementGlobalWebsocketCount() {
+		conn.Close()
+		return nil, nil, errors.New("Maximum number of WebSocket connections reached")
+	}
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	client_key := base64.StdEncoding.EncodeToString(key)
+
+	path := u.RequestURI()
+	if path == "" {
+		path = "/"
+	}
+
+	request := &strings.Builder{}
+	fmt.Fprintf(request, "GET %s HTTP/1.1\r\n", path)
+	fmt.Fprintf(request, "Host: %s\r\n", u.Host)
+	fmt.Fprintf(request, "Upgrade: websocket\r\n")
+	fmt.Fprintf(request, "Connection: Upgrade\r\n")
+	fmt.Fprintf(request, "Sec-WebSocket-Key: %s\r\n", client_key)
+	fmt.Fprintf(request, "Sec-WebSocket-Version: 13\r\n")
+	fmt.Fprintf(request, "Sec-Fetch-Mode: websocket\r\n")
+	if len(d.Subprotocols) > 0 {
+		fmt.Fprintf(request, "Sec-WebSocket-Protocol: %s\r\n", strings.Join(d.Subprotocols, ", "))
+	}
+	if len(extensions) > 0 {
+		fmt.Fprintf(request, "Sec-WebSocket-Extensions: %s\r\n", strings.Join(extensions, ", "))
+	}
+	for name, values := range header {
+		for _, value := range values {
+			fmt.Fprintf(request, "%s: %s\r\n", name, value)
+		}
+	}
+	fmt.Fprintf(request, "\r\n")
+
+	if _, err := conn.Write([]byte(request.String())); err != nil {
+		conn.Close()
+		global_websocket_count.Add(-1)
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		global_websocket_count.Add(-1)
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		global_websocket_count.Add(-1)
+		return nil, resp, fmt.Errorf("Unexpected handshake status: %s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		conn.Close()
+		global_websocket_count.Add(-1)
+		return nil, resp, errors.New("Invalid Upgrade header in handshake response")
+	}
+	if !strings.EqualFold(resp.Header.Get("Connection"), "Upgrade") {
+		conn.Close()
+		global_websocket_count.Add(-1)
+		return nil, resp, errors.New("Invalid Connection header in handshake response")
+	}
+
+	accept_key := client_key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	h := sha1.New()
+	h.Write([]byte(accept_key))
+	expected_accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if resp.Header.Get("Sec-WebSocket-Accept") != expected_accept {
+		conn.Close()
+		global_websocket_count.Add(-1)
+		return nil, resp, errors.New("Invalid Sec-WebSocket-Accept in handshake response")
+	}
+
+	var pmd *pmdConfig
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		_, pmd = negotiatePermessageDeflate(ext)
+	}
+
+	ws := &WebSocket{
+		ID:         global_id_gen.Add(1),
+		rw:         bufio.NewReadWriter(br, bufio.NewWriter(conn)),
+		conn:       conn,
+		protocol:   resp.Header.Get("Sec-WebSocket-Protocol"),
+		extensions: resp.Header.Get("Sec-WebSocket-Extensions"),
+		client_key: client_key,
+		is_client:  true,
+		pmd:        pmd,
+	}
+	registerWebSocket(ws)
+
+	go readLoop(ws)
+	go keepalive(ws)
+
+	return ws, resp, nil
+}
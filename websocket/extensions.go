@@ -0,0 +1,171 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// deflateTail is appended to a per-message deflate block before inflating it.
+// The first four bytes are the RFC 7692 sync-flush suffix that was stripped
+// off when the message was sent; the remaining five bytes are a synthetic
+// empty final block so Go's flate reader reaches a clean io.EOF instead of
+// io.ErrUnexpectedEOF while it waits for bits that will never arrive.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// pmdConfig holds the negotiated permessage-deflate (RFC 7692) parameters
+// for a single WebSocket along with the flate state needed to (de)compress
+// frames across the lifetime of the connection.
+type pmdConfig struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+
+	writer   *flate.Writer
+	writeBuf bytes.Buffer
+	reader   io.ReadCloser
+	readDict []byte
+}
+
+// negotiatePermessageDeflate parses the client's offered extensions and, if
+// permessage-deflate is offered, picks the parameters to respond with. It
+// returns the Sec-WebSocket-Extensions response value (empty if nothing was
+// accepted) and the resulting config, or a nil config if the extension was
+// not negotiated.
+func negotiatePermessageDeflate(offersHeader string) (string, *pmdConfig) {
+	for _, offer := range strings.Split(offersHeader, ",") {
+		params := strings.Split(offer, ";")
+		name := strings.TrimSpace(params[0])
+		if !strings.EqualFold(name, "permessage-deflate") {
+			continue
+		}
+
+		cfg := &pmdConfig{}
+		response := []string{"permessage-deflate"}
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if param == "" {
+				continue
+			}
+			key := param
+			value := ""
+			if idx := strings.IndexByte(param, '='); idx >= 0 {
+				key = strings.TrimSpace(param[:idx])
+				value = strings.Trim(strings.TrimSpace(param[idx+1:]), `"`)
+			}
+			switch strings.ToLower(key) {
+			case "server_no_context_takeover":
+				cfg.serverNoContextTakeover = true
+				response = append(response, "server_no_context_takeover")
+			case "client_no_context_takeover":
+				cfg.clientNoContextTakeover = true
+				response = append(response, "client_no_context_takeover")
+			case "server_max_window_bits":
+				bits := parseWindowBits(value)
+				if bits == 0 {
+					bits = 15
+				}
+				cfg.serverMaxWindowBits = bits
+				response = append(response, "server_max_window_bits="+strconv.Itoa(bits))
+			case "client_max_window_bits":
+				bits := parseWindowBits(value)
+				cfg.clientMaxWindowBits = bits
+				if value != "" {
+					response = append(response, "client_max_window_bits="+strconv.Itoa(bits))
+				} else {
+					response = append(response, "client_max_window_bits")
+				}
+			}
+		}
+
+		return strings.Join(response, "; "), cfg
+	}
+
+	return "", nil
+}
+
+func parseWindowBits(value string) int {
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < 8 || bits > 15 {
+		return 15
+	}
+	return bits
+}
+
+// deflate compresses payload for a single message sent by this endpoint. A
+// server honors server_no_context_takeover and a client honors
+// client_no_context_takeover by discarding the compression history between
+// messages instead of carrying it forward.
+func (cfg *pmdConfig) deflate(is_client bool, payload []byte) ([]byte, error) {
+	no_context_takeover := cfg.serverNoContextTakeover
+	if is_client {
+		no_context_takeover = cfg.clientNoContextTakeover
+	}
+
+	cfg.writeBuf.Reset()
+	if cfg.writer == nil || no_context_takeover {
+		writer, err := flate.NewWriter(&cfg.writeBuf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		cfg.writer = writer
+	}
+
+	if _, err := cfg.writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := cfg.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	out := cfg.writeBuf.Bytes()
+	if bytes.HasSuffix(out, []byte{0x00, 0x00, 0xff, 0xff}) {
+		out = out[:len(out)-4]
+	}
+
+	result := make([]byte, len(out))
+	copy(result, out)
+	return result, nil
+}
+
+// inflate decompresses a single message's payload received by this
+// endpoint, honoring whichever side's no_context_takeover flag governs the
+// sender's compression (client_no_context_takeover for a server, and vice
+// versa) by starting a fresh inflate window for every message instead of
+// carrying the dictionary forward.
+func (cfg *pmdConfig) inflate(is_client bool, payload []byte) ([]byte, error) {
+	no_context_takeover := cfg.clientNoContextTakeover
+	if is_client {
+		no_context_takeover = cfg.serverNoContextTakeover
+	}
+
+	src := io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail))
+
+	if cfg.reader == nil || no_context_takeover {
+		cfg.reader = flate.NewReader(src)
+	} else if resetter, ok := cfg.reader.(flate.Resetter); ok {
+		if err := resetter.Reset(src, cfg.readDict); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := io.ReadAll(cfg.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if !no_context_takeover {
+		cfg.readDict = append(cfg.readDict, out...)
+		if len(cfg.readDict) > 32768 {
+			cfg.readDict = append([]byte(nil), cfg.readDict[len(cfg.readDict)-32768:]...)
+		}
+	}
+
+	result := make([]byte, len(out))
+	copy(result, out)
+	return result, nil
+}
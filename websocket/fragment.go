@@ -0,0 +1,65 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// SendBinaryFragmented streams r as a fragmented binary message, splitting
+// it into frames of at most chunkSize bytes so large payloads don't need to
+// be buffered in memory before sending.
+func (ws *WebSocket) SendBinaryFragmented(r io.Reader, chunkSize int) error {
+	return sendFragmented(ws, OPCODE_BINARY, r, chunkSize)
+}
+
+// SendTextFragmented streams r as a fragmented text message, splitting it
+// into frames of at most chunkSize bytes so large payloads don't need to be
+// buffered in memory before sending.
+func (ws *WebSocket) SendTextFragmented(r io.Reader, chunkSize int) error {
+	return sendFragmented(ws, OPCODE_TEXT, r, chunkSize)
+}
+
+// sendFragmented holds ws.write_mu for the whole message, not just each
+// individual frame, so no other sender on the same connection (a plain
+// SendText/SendBinary, the Hub writer, another fragmented send) can land a
+// frame between this message's continuation frames - RFC 6455 section 5.4
+// forbids interleaving data frames from different messages.
+func sendFragmented(ws *WebSocket, opcode byte, r io.Reader, chunkSize int) error {
+	if chunkSize <= 0 {
+		return errors.New("chunkSize must be positive")
+	}
+
+	ws.write_mu.Lock()
+	defer ws.write_mu.Unlock()
+
+	br := bufio.NewReaderSize(r, chunkSize)
+	first := true
+
+	for {
+		chunk := make([]byte, chunkSize)
+		n, err := io.ReadFull(br, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		chunk = chunk[:n]
+
+		_, peekErr := br.Peek(1)
+		is_last := peekErr != nil
+
+		frame_opcode := OPCODE_CONTINUATION
+		if first {
+			frame_opcode = opcode
+		}
+
+		mask_key := ensureMaskKey(ws, nil)
+		if err := writeFrameLocked(ws, frame_opcode, is_last, false, mask_key, chunk); err != nil {
+			return err
+		}
+
+		first = false
+		if is_last {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package websocket
+
+import "sync"
+
+// DefaultHubHighWaterMark is the number of queued-but-unsent messages a Hub
+// member is allowed to accumulate before it is considered too slow and is
+// evicted.
+const DefaultHubHighWaterMark = 16
+
+type hubMessage struct {
+	opcode byte
+	data   []byte
+}
+
+type hubMember struct {
+	ws     *WebSocket
+	outbox chan hubMessage
+	done   chan struct{}
+}
+
+// Hub fans messages out to a set of WebSocket connections. Each member is
+// served by its own writer goroutine reading from a bounded outbound
+// channel, so one slow client blocks only itself, never the broadcaster or
+// the other members. A member that can't keep up with HighWaterMark queued
+// messages is closed with status 1008 and evicted.
+type Hub struct {
+	mu            sync.RWMutex
+	members       map[int64]*hubMember
+	HighWaterMark int
+}
+
+// NewHub creates an empty Hub with the default high-water mark.
+func NewHub() *Hub {
+	return &Hub{
+		members:       make(map[int64]*hubMember),
+		HighWaterMark: DefaultHubHighWaterMark,
+	}
+}
+
+func (h *Hub) highWaterMark() int {
+	if h.HighWaterMark > 0 {
+		return h.HighWaterMark
+	}
+	return DefaultHubHighWaterMark
+}
+
+// Join adds ws to the hub and starts its dedicated writer goroutine. It
+// wraps any existing ClosedHandler on ws so the member is evicted
+// automatically when the connection closes.
+func (h *Hub) Join(ws *WebSocket) {
+	member := &hubMember{
+		ws:     ws,
+		outbox: make(chan hubMessage, h.highWaterMark()),
+		done:   make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	h.members[ws.ID] = member
+	h.mu.Unlock()
+
+	go h.writeLoop(member)
+
+	previous := ws.ClosedHandler
+	ws.ClosedHandler = func(closed *WebSocket) {
+		h.Leave(closed)
+		if previous != nil {
+			previous(closed)
+		}
+	}
+}
+
+// Leave removes ws from the hub, if present, and stops its writer
+// goroutine.
+func (h *Hub) Leave(ws *WebSocket) {
+	h.mu.Lock()
+	member, ok := h.members[ws.ID]
+	if ok {
+		delete(h.members, ws.ID)
+	}
+	h.mu.Unlock()
+
+	if ok {
+		close(member.done)
+	}
+}
+
+// Len returns the number of members currently in the hub.
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.members)
+}
+
+// Range calls fn for every member currently in the hub, stopping early if
+// fn returns false. It lets applications build presence features (roster
+// lists, per-user lookups, ...) without reaching into Hub's internals.
+func (h *Hub) Range(fn func(ws *WebSocket) bool) {
+	h.mu.RLock()
+	members := make([]*WebSocket, 0, len(h.members))
+	for _, member := range h.members {
+		members = append(members, member.ws)
+	}
+	h.mu.RUnlock()
+
+	for _, ws := range members {
+		if !fn(ws) {
+			return
+		}
+	}
+}
+
+// BroadcastText queues message for delivery to every member.
+func (h *Hub) BroadcastText(message string) {
+	h.broadcast(0, hubMessage{opcode: OPCODE_TEXT, data: []byte(message)})
+}
+
+// BroadcastBinary queues message for delivery to every member.
+func (h *Hub) BroadcastBinary(message []byte) {
+	h.broadcast(0, hubMessage{opcode: OPCODE_BINARY, data: message})
+}
+
+// BroadcastTextExcept queues message for delivery to every member other
+// than sender.
+func (h *Hub) BroadcastTextExcept(sender *WebSocket, message string) {
+	h.broadcast(sender.ID, hubMessage{opcode: OPCODE_TEXT, data: []byte(message)})
+}
+
+// BroadcastBinaryExcept queues message for delivery to every member other
+// than sender.
+func (h *Hub) BroadcastBinaryExcept(sender *WebSocket, message []byte) {
+	h.broadcast(sender.ID, hubMessage{opcode: OPCODE_BINARY, data: message})
+}
+
+func (h *Hub) broadcast(except_id int64, msg hubMessage) {
+	h.mu.RLock()
+	members := make([]*hubMember, 0, len(h.members))
+	for id, member := range h.members {
+		if id == except_id {
+			continue
+		}
+		members = append(members, member)
+	}
+	h.mu.RUnlock()
+
+	for _, member := range members {
+		h.enqueue(member, msg)
+	}
+}
+
+func (h *Hub) enqueue(member *hubMember, msg hubMessage) {
+	select {
+	case member.outbox <- msg:
+	default:
+		h.Leave(member.ws)
+		closeWithCode(member.ws, 1008, "Send buffer full")
+	}
+}
+
+func (h *Hub) writeLoop(member *hubMember) {
+	for {
+		select {
+		case <-member.done:
+			return
+		case msg, ok := <-member.outbox:
+			if !ok {
+				return
+			}
+			if msg.opcode == OPCODE_TEXT {
+				member.ws.SendText(string(msg.data))
+			} else {
+				member.ws.SendBinary(msg.data)
+			}
+		}
+	}
+}
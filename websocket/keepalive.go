@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// DefaultPingInterval, DefaultPongTimeout, and DefaultIdleTimeout are the
+// keepalive defaults applied to every WebSocket created by Upgrade or Dial.
+// PongTimeout and IdleTimeout can be overridden per-connection by setting the
+// corresponding fields; PingInterval is read once when the keepalive
+// goroutine starts, which Upgrade and Dial launch before they return, so a
+// later change to it is not guaranteed to take effect.
+const (
+	DefaultPingInterval = 30 * time.Second
+	DefaultPongTimeout  = 10 * time.Second
+	DefaultIdleTimeout  = 60 * time.Second
+)
+
+// keepalive periodically pings ws and closes it with 1011 if the peer stops
+// responding to pings or goes idle. It exits once ws.keepalive_done is
+// closed by closeWebSocket.
+func keepalive(ws *WebSocket) {
+	if ws.PingInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(ws.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ws.keepalive_done:
+			return
+		case <-ticker.C:
+			if ws.PongTimeout > 0 && ws.pending_ping.Load() != 0 {
+				sentAt := time.Unix(0, ws.ping_sent_at.Load())
+				if time.Since(sentAt) > ws.PongTimeout {
+					closeWithCode(ws, 1011, "Ping timeout")
+					return
+				}
+			}
+
+			if ws.IdleTimeout > 0 {
+				lastActive := time.Unix(0, ws.last_active.Load())
+				if time.Since(lastActive) > ws.IdleTimeout {
+					closeWithCode(ws, 1011, "Idle timeout")
+					return
+				}
+			}
+
+			token := ws.ping_token.Add(1)
+			payload := make([]byte, 8)
+			binary.BigEndian.PutUint64(payload, uint64(token))
+			ws.pending_ping.Store(token)
+			ws.ping_sent_at.Store(time.Now().UnixNano())
+			sendFrame(ws, OPCODE_PING, nil, payload)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package websocket
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// UpgradeConfig controls how Upgrade accepts a handshake. The zero value
+// (or a nil *UpgradeConfig passed to Upgrade) only accepts same-host
+// requests, offers no subprotocol, and applies no handshake deadline.
+type UpgradeConfig struct {
+	// CheckOrigin reports whether the handshake's Origin header should be
+	// accepted. If nil, defaultCheckOrigin is used, which only allows the
+	// Origin to match the request's Host. To accept cross-origin
+	// connections, set this to a function that inspects r and returns true
+	// for the origins you trust - for example:
+	//
+	//	config := &websocket.UpgradeConfig{
+	//		CheckOrigin: func(r *http.Request) bool {
+	//			return r.Header.Get("Origin") == "https://example.com"
+	//		},
+	//	}
+	CheckOrigin func(r *http.Request) bool
+
+	// Subprotocols lists the application subprotocols this server
+	// supports, in no particular order. The client's offer is matched
+	// against this list in the client's preference order.
+	Subprotocols []string
+
+	// HandshakeTimeout bounds how long writing the 101 response is allowed
+	// to take. The deadline is set after the connection is hijacked, so the
+	// time net/http spent reading the request is not covered. Zero means no
+	// deadline.
+	HandshakeTimeout time.Duration
+}
+
+// defaultCheckOrigin permits the handshake only when the Origin header's
+// host matches the request's own Host, i.e. same-host requests.
+func defaultCheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,61 @@
+package websocket
+
+import "unicode/utf8"
+
+// utf8State validates a stream of UTF-8 text frames fragment by fragment,
+// carrying an incomplete trailing code point over to the next call so a
+// multi-byte character split across frame boundaries is still caught.
+type utf8State struct {
+	pending []byte
+}
+
+// validate feeds the next chunk of a text message into the validator. final
+// must be true for the chunk that completes the message (the FIN frame),
+// so a code point left incomplete at the very end is correctly rejected.
+func (s *utf8State) validate(chunk []byte, final bool) bool {
+	buf := append(s.pending, chunk...)
+	s.pending = nil
+
+	for len(buf) > 0 {
+		if utf8.FullRune(buf) {
+			r, size := utf8.DecodeRune(buf)
+			if r == utf8.RuneError && size == 1 {
+				return false
+			}
+			buf = buf[size:]
+			continue
+		}
+		if final {
+			return false
+		}
+		s.pending = append([]byte(nil), buf...)
+		return true
+	}
+
+	return true
+}
+
+// isValidCloseCode reports whether code is an allowed WebSocket close
+// status code per RFC 6455 section 7.4. 1004, 1005, 1006, and 1015 are
+// reserved and must never appear on the wire; 1016-2999 is reserved for
+// future protocol use.
+func isValidCloseCode(code uint16) bool {
+	switch {
+	case code < 1000:
+		return false
+	case code <= 1003:
+		return true
+	case code == 1004 || code == 1005 || code == 1006:
+		return false
+	case code <= 1014:
+		return true
+	case code == 1015:
+		return false
+	case code <= 2999:
+		return false
+	case code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
@@ -10,6 +10,7 @@ package websocket
 
 import (
 	"bufio"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
@@ -20,15 +21,10 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
-/*  TODO
-Implement Ping Keepalive to remove dead connections
-Support Origin validation
-Support permessage-deflate extension
-Support fragmented frames?
-*/
-
 var global_id_gen atomic.Int64 = atomic.Int64{}
 var global_websocket_count atomic.Int32 = atomic.Int32{}
 var global_websockets sync.Map = sync.Map{}
@@ -55,7 +51,23 @@ type WebSocket struct {
 	protocol             string
 	extensions           string
 	client_key           string
-	is_open              bool
+	is_open              atomic.Bool
+	is_client            bool
+	pmd                  *pmdConfig
+	fragment_opcode      byte
+	fragment_buffer      []byte
+	fragment_rsv1        bool
+	utf8_state           *utf8State
+	PingInterval         time.Duration
+	PongTimeout          time.Duration
+	IdleTimeout          time.Duration
+	last_active          atomic.Int64
+	ping_token           atomic.Int64
+	pending_ping         atomic.Int64
+	ping_sent_at         atomic.Int64
+	keepalive_done       chan struct{}
+	write_mu             sync.Mutex
+	close_once           sync.Once
 	ReceiveBinaryHandler WebSocketReceiveBinaryHandler
 	ReceiveTextHandler   WebSocketReceiveTextHandler
 	ClosedHandler        WebSocketClosedHandler
@@ -69,12 +81,21 @@ func (ws *WebSocket) SendText(message string) error {
 	return sendFrame(ws, OPCODE_TEXT, nil, []byte(message))
 }
 
-func Upgrade(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+// Upgrade upgrades an HTTP request to a WebSocket connection. config may be
+// nil to accept same-host connections with no subprotocol and no handshake
+// deadline; see UpgradeConfig for the available options.
+func Upgrade(w http.ResponseWriter, r *http.Request, config *UpgradeConfig) (*WebSocket, error) {
+	if config == nil {
+		config = &UpgradeConfig{}
+	}
 
-	ws, err := makeWebSocket(w, r)
+	ws, err := makeWebSocket(w, r, config)
 	if err != nil {
 		return nil, err
 	}
+	if config.HandshakeTimeout > 0 {
+		defer ws.conn.SetDeadline(time.Time{})
+	}
 
 	err = sendWebSocketHandshakeResponse(ws)
 	if err != nil {
@@ -82,22 +103,36 @@ func Upgrade(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
 	}
 
 	go readLoop(ws)
+	go keepalive(ws)
 
 	return ws, nil
 }
 
-func validateProtocolHeader(value string) (string, error) {
-	if len(value) > 0 {
-		return "", fmt.Errorf("Unsupported WebSocket protocol: %s", value)
+// validateProtocolHeader picks the first subprotocol in value (the client's
+// comma-separated Sec-WebSocket-Protocol offer, in preference order) that
+// also appears in serverProtocols. An empty value is not an error - it
+// means the client did not request a subprotocol.
+func validateProtocolHeader(value string, serverProtocols []string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	for _, candidate := range strings.Split(value, ",") {
+		candidate = strings.TrimSpace(candidate)
+		for _, supported := range serverProtocols {
+			if strings.EqualFold(candidate, supported) {
+				return candidate, nil
+			}
+		}
 	}
-	return "", nil
+	return "", fmt.Errorf("Unsupported WebSocket protocol: %s", value)
 }
 
-func validateExtensionsHeader(value string) (string, error) {
-	// if len(value) > 0 {
-	// 	return "", fmt.Errorf("Unsupported WebSocket protocol: %s", value)
-	// }
-	return "", nil // ignore extensions for now
+func validateExtensionsHeader(value string) (string, *pmdConfig, error) {
+	if value == "" {
+		return "", nil, nil
+	}
+	header, pmd := negotiatePermessageDeflate(value)
+	return header, pmd, nil
 }
 
 func makeStatusCodeBytes(code uint16) []byte {
@@ -106,20 +141,26 @@ func makeStatusCodeBytes(code uint16) []byte {
 	return buf
 }
 
+// closeWebSocket tears down ws. It can be called concurrently from
+// readLoop's error path, keepalive's timeout paths, and a Hub's eviction
+// path, so close_once ensures the teardown body - which isn't safe to run
+// twice (closing keepalive_done, decrementing the connection count,
+// invoking ClosedHandler) - only ever runs once.
 func closeWebSocket(ws *WebSocket, data []byte) {
-	if ws.is_open {
-		ws.is_open = false
+	ws.close_once.Do(func() {
+		ws.is_open.Store(false)
 		global_websockets.Delete(ws.ID)
 		sendFrame(ws, OPCODE_CLOSE, nil, data)
 		ws.conn.Close()
 		global_websocket_count.Add(-1)
+		close(ws.keepalive_done)
 		if ws.ClosedHandler != nil {
 			ws.ClosedHandler(ws)
 		}
-	}
+	})
 }
 
-func makeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+func makeWebSocket(w http.ResponseWriter, r *http.Request, config *UpgradeConfig) (*WebSocket, error) {
 	if r.Method != "GET" {
 		return nil, fmt.Errorf("Invalid HTTP method: %s", r.Method)
 	}
@@ -143,19 +184,22 @@ func makeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
 		return nil, fmt.Errorf("Unsupported WebSocket version: %s", header)
 	}
 
-	ws_protocol, err := validateProtocolHeader(r.Header.Get("Sec-WebSocket-Protocol"))
+	ws_protocol, err := validateProtocolHeader(r.Header.Get("Sec-WebSocket-Protocol"), config.Subprotocols)
 	if err != nil {
 		return nil, err
 	}
 
-	ws_extensions, err := validateExtensionsHeader(r.Header.Get("Sec-WebSocket-Extensions"))
+	ws_extensions, pmd, err := validateExtensionsHeader(r.Header.Get("Sec-WebSocket-Extensions"))
 	if err != nil {
 		return nil, err
 	}
 
-	origin := r.Header.Get("Origin")
-	if origin == "" {
-		return nil, errors.New("Missing Origin header")
+	checkOrigin := config.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = defaultCheckOrigin
+	}
+	if !checkOrigin(r) {
+		return nil, fmt.Errorf("Origin not allowed: %s", r.Header.Get("Origin"))
 	}
 
 	client_key := r.Header.Get("Sec-WebSocket-Key")
@@ -171,6 +215,9 @@ func makeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
 	if err != nil {
 		return nil, err
 	}
+	if config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+	}
 
 	ws := &WebSocket{
 		ID:         global_id_gen.Add(1),
@@ -179,11 +226,23 @@ func makeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
 		protocol:   ws_protocol,
 		extensions: ws_extensions,
 		client_key: client_key,
-		is_open:    true,
+		pmd:        pmd,
 	}
+	registerWebSocket(ws)
+	return ws, nil
+}
 
+// registerWebSocket fills in the fields shared by every WebSocket
+// regardless of how it was created (server-side Upgrade or client-side
+// Dial) and makes it visible to the package's connection registry.
+func registerWebSocket(ws *WebSocket) {
+	ws.is_open.Store(true)
+	ws.PingInterval = DefaultPingInterval
+	ws.PongTimeout = DefaultPongTimeout
+	ws.IdleTimeout = DefaultIdleTimeout
+	ws.keepalive_done = make(chan struct{})
+	ws.last_active.Store(time.Now().UnixNano())
 	global_websockets.Store(ws.ID, ws)
-	return ws, nil
 }
 
 func incrementGlobalWebsocketCount() bool {
@@ -234,21 +293,23 @@ func readLoop(ws *WebSocket) {
 }
 
 func readFrame(ws *WebSocket) error {
+	if ws.IdleTimeout > 0 {
+		ws.conn.SetReadDeadline(time.Now().Add(ws.IdleTimeout))
+	}
 	b1, err := ws.rw.ReadByte()
 	if err != nil {
 		return err
 	}
-	if ws.is_open == false {
+	if !ws.is_open.Load() {
 		return errors.New("WebSocket is closed")
 	}
+	ws.last_active.Store(time.Now().UnixNano())
 	fin := b1&0x80 == 0x80
-	if !fin {
-		return errors.New("Fragmented frames are not supported")
-	}
 	rsv1 := b1&0x40 == 0x40
 	rsv2 := b1&0x20 == 0x20
 	rsv3 := b1&0x10 == 0x10
-	if rsv1 || rsv2 || rsv3 {
+	if rsv2 || rsv3 {
+		closeWithCode(ws, 1002, "Unsupported RSV bits set")
 		return errors.New("Unsupported RSV bits set")
 	}
 	opcode := b1 & 0x0F
@@ -258,9 +319,27 @@ func readFrame(ws *WebSocket) error {
 	is_close := opcode == OPCODE_CLOSE
 	is_ping := opcode == OPCODE_PING
 	is_pong := opcode == OPCODE_PONG
-	if !(is_continuation || is_text || is_binary || is_close || is_ping || is_pong) {
+	is_control := is_close || is_ping || is_pong
+	if !(is_continuation || is_text || is_binary || is_control) {
+		closeWithCode(ws, 1002, fmt.Sprintf("Unsupported opcode %d", opcode))
 		return fmt.Errorf("Unsupported opcode %d", opcode)
 	}
+	if rsv1 && (ws.pmd == nil || is_control || is_continuation) {
+		closeWithCode(ws, 1002, "Unsupported RSV bits set")
+		return errors.New("Unsupported RSV bits set")
+	}
+	if is_control && !fin {
+		closeWithCode(ws, 1002, "Control frames must not be fragmented")
+		return errors.New("Control frames must not be fragmented")
+	}
+	if is_continuation && ws.fragment_opcode == 0 {
+		closeWithCode(ws, 1002, "Unexpected continuation frame")
+		return errors.New("Unexpected continuation frame")
+	}
+	if (is_text || is_binary) && ws.fragment_opcode != 0 {
+		closeWithCode(ws, 1002, "Data frame received while a fragmented message is in progress")
+		return errors.New("Data frame received while a fragmented message is in progress")
+	}
 
 	b2, err := ws.rw.ReadByte()
 	if err != nil {
@@ -270,6 +349,15 @@ func readFrame(ws *WebSocket) error {
 	payload_len := int64(b2 & 0x7F)
 	mask_key := make([]byte, 4)
 
+	if ws.is_client && is_masked {
+		closeWithCode(ws, 1002, "Server frames must not be masked")
+		return errors.New("Server frames must not be masked")
+	}
+	if !ws.is_client && !is_masked {
+		closeWithCode(ws, 1002, "Client frames must be masked")
+		return errors.New("Client frames must be masked")
+	}
+
 	if payload_len == 126 {
 		buffer := make([]byte, 2)
 		n, err := ws.rw.Read(buffer)
@@ -293,7 +381,13 @@ func readFrame(ws *WebSocket) error {
 			int64(buffer[4])<<24 | int64(buffer[5])<<16 | int64(buffer[6])<<8 | int64(buffer[7])
 	}
 
+	if is_control && payload_len > 125 {
+		closeWithCode(ws, 1002, "Control frame payload exceeds 125 bytes")
+		return errors.New("Control frame payload exceeds 125 bytes")
+	}
+
 	if payload_len > global_frame_max_size {
+		closeWithCode(ws, 1009, "Message too big")
 		return fmt.Errorf("Payload length %d exceeds maximum frame size %d", payload_len, global_frame_max_size)
 	}
 
@@ -322,19 +416,100 @@ func readFrame(ws *WebSocket) error {
 	}
 
 	if is_close {
-		closeWebSocket(ws, data)
+		if len(data) == 1 {
+			closeWithCode(ws, 1002, "Invalid close frame")
+			return errors.New("Invalid close frame")
+		}
+		if len(data) >= 2 {
+			code := binary.BigEndian.Uint16(data[:2])
+			if !isValidCloseCode(code) {
+				closeWithCode(ws, 1002, "Invalid close code")
+				return errors.New("Invalid close code")
+			}
+			if !utf8.Valid(data[2:]) {
+				closeWithCode(ws, 1007, "Invalid UTF-8 in close reason")
+				return errors.New("Invalid UTF-8 in close reason")
+			}
+			closeWebSocket(ws, data)
+		} else {
+			closeWebSocket(ws, makeStatusCodeBytes(ERROR_CODE_NORMAL_CLOSURE))
+		}
+		return nil
 	} else if is_ping {
 		sendFrame(ws, OPCODE_PONG, nil, data)
+		return nil
 	} else if is_pong {
-		// Ignore pong frames for now
-		// TODO: Implement ping keepalive
-		// Pongs will be used to update last active timestamp
-	} else if is_text {
+		if len(data) == 8 && binary.BigEndian.Uint64(data) == uint64(ws.pending_ping.Load()) {
+			ws.pending_ping.Store(0)
+		}
+		return nil
+	}
+
+	// Uncompressed text is validated as UTF-8 incrementally, one fragment at
+	// a time, so a bad code point split across frames is still caught.
+	// Compressed text can only be validated once the whole message has been
+	// inflated, below.
+	var is_text_message, is_compressed_message bool
+	if is_continuation {
+		is_text_message = ws.fragment_opcode == OPCODE_TEXT
+		is_compressed_message = ws.fragment_rsv1
+	} else {
+		is_text_message = is_text
+		is_compressed_message = rsv1
+	}
+	if is_text_message && !is_compressed_message {
+		if ws.utf8_state == nil {
+			ws.utf8_state = &utf8State{}
+		}
+		if !ws.utf8_state.validate(data, fin) {
+			closeWithCode(ws, 1007, "Invalid UTF-8")
+			return errors.New("Invalid UTF-8")
+		}
+	}
+
+	// is_text, is_binary, or is_continuation: assemble the (possibly
+	// fragmented) message before dispatching it.
+	var message_opcode byte
+	var message_rsv1 bool
+	if is_continuation {
+		ws.fragment_buffer = append(ws.fragment_buffer, data...)
+		if !fin {
+			return nil
+		}
+		data = ws.fragment_buffer
+		message_opcode = ws.fragment_opcode
+		message_rsv1 = ws.fragment_rsv1
+		ws.fragment_opcode = 0
+		ws.fragment_buffer = nil
+		ws.utf8_state = nil
+	} else if !fin {
+		ws.fragment_opcode = opcode
+		ws.fragment_rsv1 = rsv1
+		ws.fragment_buffer = append([]byte(nil), data...)
+		return nil
+	} else {
+		message_opcode = opcode
+		ws.utf8_state = nil
+		message_rsv1 = rsv1
+	}
+
+	if message_rsv1 {
+		inflated, err := ws.pmd.inflate(ws.is_client, data)
+		if err != nil {
+			return err
+		}
+		data = inflated
+		if message_opcode == OPCODE_TEXT && !utf8.Valid(data) {
+			closeWithCode(ws, 1007, "Invalid UTF-8")
+			return errors.New("Invalid UTF-8")
+		}
+	}
+
+	if message_opcode == OPCODE_TEXT {
 		if ws.ReceiveTextHandler != nil {
-			s := string(data)
-			ws.ReceiveTextHandler(ws, s)
+			ws.ReceiveTextHandler(ws, string(data))
 		}
-	} else if is_binary {
+	} else if message_opcode == OPCODE_BINARY {
 		if ws.ReceiveBinaryHandler != nil {
 			ws.ReceiveBinaryHandler(ws, data)
 		}
@@ -343,14 +518,75 @@ func readFrame(ws *WebSocket) error {
 	return nil
 }
 
+func closeWithCode(ws *WebSocket, code uint16, reason string) {
+	closeWebSocket(ws, append(makeStatusCodeBytes(code), []byte(reason)...))
+}
+
+// sendFrame compresses (if negotiated) and writes a single complete
+// message. It holds ws.write_mu across both steps: pmdConfig's deflate
+// state is stateful across messages, so two concurrent senders must not
+// interleave their compress calls any more than they may interleave their
+// writes.
 func sendFrame(ws *WebSocket, opcode byte, mask_key []byte, payload []byte) error {
+	ws.write_mu.Lock()
+	defer ws.write_mu.Unlock()
+
+	rsv1 := false
+	if ws.pmd != nil && (opcode == OPCODE_TEXT || opcode == OPCODE_BINARY) {
+		compressed, err := ws.pmd.deflate(ws.is_client, payload)
+		if err != nil {
+			return err
+		}
+		payload = compressed
+		rsv1 = true
+	}
+	mask_key = ensureMaskKey(ws, mask_key)
+	return writeFrameLocked(ws, opcode, true, rsv1, mask_key, payload)
+}
+
+// ensureMaskKey returns mask_key unchanged unless ws is a client connection
+// without an explicit mask, in which case it generates a fresh random
+// 4-byte mask as RFC 6455 requires every client-to-server frame to be
+// masked with its own key.
+func ensureMaskKey(ws *WebSocket, mask_key []byte) []byte {
+	if ws.is_client && len(mask_key) != 4 {
+		mask_key = make([]byte, 4)
+		rand.Read(mask_key)
+	}
+	return mask_key
+}
+
+// writeFrame serializes and writes a single frame. It holds ws.write_mu for
+// the whole header+payload+flush sequence because ws.rw is shared by the
+// keepalive goroutine, any Hub writer goroutine, and the application's own
+// SendText/SendBinary calls, and bufio.Writer is not safe for concurrent use.
+func writeFrame(ws *WebSocket, opcode byte, fin bool, rsv1 bool, mask_key []byte, payload []byte) error {
+	ws.write_mu.Lock()
+	defer ws.write_mu.Unlock()
+	return writeFrameLocked(ws, opcode, fin, rsv1, mask_key, payload)
+}
+
+// writeFrameLocked is writeFrame's body, callable by code that already
+// holds ws.write_mu (sendFrame, sendFragmented) so a caller can serialize
+// several frames - or a compress step plus a frame - as one atomic send.
+func writeFrameLocked(ws *WebSocket, opcode byte, fin bool, rsv1 bool, mask_key []byte, payload []byte) error {
+	if ws.IdleTimeout > 0 {
+		ws.conn.SetWriteDeadline(time.Now().Add(ws.IdleTimeout))
+	}
 	payload_len := len(payload)
-	fin := byte(0x80)
 	header_length := 2
 	if opcode > 0x0F {
 		return fmt.Errorf("Invalid opcode: %d", opcode)
 	}
-	b1 := fin | opcode
+	finBit := byte(0x00)
+	if fin {
+		finBit = 0x80
+	}
+	rsv1Bit := byte(0x00)
+	if rsv1 {
+		rsv1Bit = 0x40
+	}
+	b1 := finBit | rsv1Bit | opcode
 	masked := byte(0x00)
 	if len(mask_key) == 4 {
 		masked = 0x80
@@ -10,7 +10,7 @@ import (
 func main() {
 	fmt.Println("Starting Test Server")
 
-	chats := []*websocket.WebSocket{}
+	chats := websocket.NewHub()
 
 	http.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
 		PrintRequestLine(r)
@@ -31,30 +31,24 @@ func main() {
 
 		PrintRequestLine(r)
 
-		ws, err := websocket.Upgrade(w, r)
+		ws, err := websocket.Upgrade(w, r, nil)
 		if err != nil {
 			fmt.Println(err.Error())
 			http.Error(w, "Could not upgrade to WebSocket", http.StatusInternalServerError)
 			return
 		}
 
-		for _, other_ws := range chats {
-			other_ws.SendText("A new user has entered the chat!")
-		}
+		chats.BroadcastText("A new user has entered the chat!")
 
 		ws.ReceiveTextHandler = (func(ws *websocket.WebSocket, message string) {
-			for _, other_ws := range chats {
-				other_ws.SendText(message)
-			}
+			chats.BroadcastTextExcept(ws, message)
 		})
 
 		ws.ClosedHandler = (func(ws *websocket.WebSocket) {
-			for _, other_ws := range chats {
-				other_ws.SendText("A user has left the chat.")
-			}
+			chats.BroadcastText("A user has left the chat.")
 		})
 
-		chats = append(chats, ws)
+		chats.Join(ws)
 
 		ws.SendText("Welcome to the Chat!")
 	})
@@ -73,7 +67,7 @@ func main() {
 
 		PrintRequestLine(r)
 
-		ws, err := websocket.Upgrade(w, r)
+		ws, err := websocket.Upgrade(w, r, nil)
 		if err != nil {
 			fmt.Println(err.Error())
 			http.Error(w, "Could not upgrade to WebSocket", http.StatusInternalServerError)